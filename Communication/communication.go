@@ -1,12 +1,13 @@
 package Communication
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 
+	protolib "github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	pb "Chaincode/proto"
 )
 
 type ConfidentialMessageBySender struct {
@@ -36,81 +37,14 @@ type SmartContract struct {
 }
 
 // sender给receiver发送消息时，为了使receiver能够知道有消息到来，需要在公共区域创建一个消息到来的通知
+// kind固定为"mn"，对应1:1消息；群聊/SKDM的通知请看group.go里通用化的CreateNotice
 func (s *SmartContract) CreateMessageNotice(ctx contractapi.TransactionContextInterface, sender string, receiver string) error {
-
-	key, err := ctx.GetStub().CreateCompositeKey("mn", []string{receiver, sender})
-	if err != nil {
-		return fmt.Errorf("failed to create composite key: %s", err.Error())
-	}
-
-	messageNoticeBytes, err := ctx.GetStub().GetState(key)
-	if err != nil {
-		return fmt.Errorf("failed to read message notice: %s", err.Error())
-	}
-	if bytes.Equal(messageNoticeBytes, []byte("1")) {
-		// notice存在，但是未被读，此时什么都不做
-		return nil
-	}
-
-	// notice不存在，说明是第一次发送消息
-	// 或者notice存在，但是已被读，此时更新
-	err = ctx.GetStub().PutState(key, []byte("1"))
-	if err != nil {
-		return fmt.Errorf("failed to put value: %s", err.Error())
-	}
-	return nil
+	return s.CreateNotice(ctx, receiver, sender, noticeKindMessage)
 }
 
 // receiver读消息时，查找消息通知确定谁给自己发消息了
 func (s *SmartContract) ReadMessageNotice(ctx contractapi.TransactionContextInterface, receiver string) ([]string, error) {
-
-	rs, err := ctx.GetStub().GetStateByPartialCompositeKey("mn", []string{receiver})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create composite key: %s", err.Error())
-	}
-	defer rs.Close()
-
-	var senders []string
-
-	for rs.HasNext() {
-		item, err := rs.Next()
-		if err != nil {
-			return nil, err
-		}
-		// fmt.Println("item.Key, item.Value: ")
-		// fmt.Println(item.Key, item.Value)
-
-		if bytes.Equal(item.Value, []byte("1")) {
-			// notice存在，未被读，说明来了新消息
-			_, keyPart, err := ctx.GetStub().SplitCompositeKey(item.Key)
-			if err != nil {
-				return nil, fmt.Errorf("failed to split composite key: %s", err.Error())
-			}
-			sender := keyPart[1]
-			senders = append(senders, sender)
-
-			key, err := ctx.GetStub().CreateCompositeKey("mn", []string{receiver, sender})
-			if err != nil {
-				return nil, fmt.Errorf("failed to create composite key: %s", err.Error())
-			}
-
-			err = ctx.GetStub().PutState(key, []byte("0"))
-			if err != nil {
-				return nil, fmt.Errorf("failed to put value: %s", err.Error())
-			}
-		} else {
-			// notice存在，已被读，还是原来的旧消息
-			// 这时候如果后端数据库没有保存已读的消息，那么还是需要从链上读
-			// 否则不需要，正常来讲应该不需要了。但是这里假设后端为了简便没保存已读消息
-			_, keyPart, err := ctx.GetStub().SplitCompositeKey(item.Key)
-			if err != nil {
-				return nil, fmt.Errorf("failed to split composite key: %s", err.Error())
-			}
-			sender := keyPart[0]
-			senders = append(senders, sender)
-		}
-	}
-	return senders, nil
+	return s.ReadNotice(ctx, receiver, noticeKindMessage)
 }
 
 func (s *SmartContract) CreateConfidentialMessageBySender(ctx contractapi.TransactionContextInterface) error {
@@ -121,27 +55,26 @@ func (s *SmartContract) CreateConfidentialMessageBySender(ctx contractapi.Transa
 	}
 
 	// Marble properties are private, therefore they get passed in transient field
-	transientMessageJSON, ok := transMap["message"]
+	transientMessageBytes, ok := transMap["message"]
 	if !ok {
 		return fmt.Errorf("message not found in the transient map")
 	}
 
-	var messageInput ConfidentialMessageBySender
-	err = json.Unmarshal(transientMessageJSON, &messageInput)
+	envelope, err := decodeEnvelope(transientMessageBytes)
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal JSON: %s", err.Error())
+		return err
 	}
 
-	if len(messageInput.Sender) == 0 {
+	if len(envelope.Sender) == 0 {
 		return fmt.Errorf("sender field must be a non-empty string")
 	}
-	if len(messageInput.Receivers) == 0 {
+	if len(envelope.Receivers) == 0 {
 		return fmt.Errorf("receivers field must be a non-empty string")
 	}
-	if len(messageInput.Message) == 0 {
+	if len(envelope.Ciphertext) == 0 {
 		return fmt.Errorf("message field must be a non-empty string")
 	}
-	if len(messageInput.Note) == 0 {
+	if len(envelope.Note) == 0 {
 		return fmt.Errorf("note field must be a non-empty string")
 	}
 
@@ -150,8 +83,8 @@ func (s *SmartContract) CreateConfidentialMessageBySender(ctx contractapi.Transa
 	if err != nil {
 		return fmt.Errorf("failed to get verified MSPID: %v", err)
 	}
-	if messageInput.Sender+"MSP" != clientMSPID {
-		return fmt.Errorf("sender %s and client MSPID %s is not match: %v", messageInput.Sender, clientMSPID, err)
+	if envelope.Sender+"MSP" != clientMSPID {
+		return fmt.Errorf("sender %s and client MSPID %s is not match: %v", envelope.Sender, clientMSPID, err)
 	}
 
 	err = verifyClientOrgMatchesPeerOrg(ctx)
@@ -159,48 +92,31 @@ func (s *SmartContract) CreateConfidentialMessageBySender(ctx contractapi.Transa
 		return fmt.Errorf("CreateMessage cannot be performed: Error %v", err)
 	}
 
-	for i := 0; i < len(messageInput.Receivers); i++ {
-		// ==== Check if message already exists ====
-		var messages [][]byte
-		var notes []string
-
-		oldMessageAsBytes, err := ctx.GetStub().GetPrivateData(messageInput.Sender+"MSPCollection", messageInput.Receivers[i])
+	for i := 0; i < len(envelope.Receivers); i++ {
+		receiver := envelope.Receivers[i]
+
+		// ==== Store this one envelope under its own ("msg", sender, receiver, seq) key ====
+		_, err := storeMessage(ctx, envelope.Sender, receiver, &pb.Envelope{
+			Version:      CurrentEnvelopeVersion,
+			Sender:       envelope.Sender,
+			Receivers:    []string{receiver},
+			Ciphertext:   envelope.Ciphertext,
+			Note:         envelope.Note,
+			Nonce:        envelope.Nonce,
+			TimestampNs:  envelope.TimestampNs,
+			ContentType:  envelope.ContentType,
+			PrevHash:     envelope.PrevHash,
+			ExpiresAtNs:  envelope.ExpiresAtNs,
+			EphemeralPub: envelope.EphemeralPub,
+			PreKeyID:     envelope.PreKeyID,
+			Pn:           envelope.Pn,
+			N:            envelope.N,
+		})
 		if err != nil {
-			return fmt.Errorf("Failed to get message: " + err.Error())
-		} else if oldMessageAsBytes != nil {
-			var oldMessage MessageForReceiver
-			err = json.Unmarshal(oldMessageAsBytes, &oldMessage)
-			if err != nil {
-				return fmt.Errorf("failed to unmarshal JSON: %v", err)
-			}
-			messages = oldMessage.Messages
-			messages = append(messages, messageInput.Message)
-			notes = oldMessage.Notes
-			notes = append(notes, messageInput.Note)
-		} else if oldMessageAsBytes == nil {
-			messages = append(messages, messageInput.Message)
-			notes = append(notes, messageInput.Note)
-		}
-
-		// ==== Create message object, marshal to JSON, and update to state ====
-		newMessage := MessageForReceiver{
-			Sender:   messageInput.Sender,
-			Receiver: messageInput.Receivers[i],
-			Messages: messages,
-			Notes:    notes,
+			return err
 		}
 
-		newMessageJSONasBytes, err := json.Marshal(newMessage)
-		if err != nil {
-			return fmt.Errorf(err.Error())
-		}
-
-		err = ctx.GetStub().PutPrivateData(messageInput.Sender+"MSPCollection", messageInput.Receivers[i], newMessageJSONasBytes)
-		if err != nil {
-			return fmt.Errorf("failed to put Marble: %s", err.Error())
-		}
-
-		err = s.CreateMessageNotice(ctx, newMessage.Sender, newMessage.Receiver)
+		err = s.CreateMessageNotice(ctx, envelope.Sender, receiver)
 		if err != nil {
 			return fmt.Errorf("failed to create message notice: %s", err.Error())
 		}
@@ -262,32 +178,66 @@ func (s *SmartContract) ReadConfidentialMessage(ctx contractapi.TransactionConte
 	// 	return nil, fmt.Errorf("CreateMessage cannot be performed: Error %v", err)
 	// }
 
-	messageAsBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", receiver)
+	messages, _, err := loadMessages(ctx, sender, receiver, 0, 0)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to get message: " + err.Error())
-	} else if messageAsBytes == nil {
-		return nil, fmt.Errorf("there is no messgae to %s in %s", receiver, sender+"MSPCollection")
+		return nil, err
 	}
-
-	var message MessageForReceiver
-	err = json.Unmarshal(messageAsBytes, &message)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("there is no messgae to %s in %s", receiver, sender+"MSPCollection")
 	}
 
+	// NOTE: string(ciphertext) mangles anything that isn't valid UTF-8. It is kept
+	// here only for backwards compatibility with existing callers of this method;
+	// clients with binary payloads should call ReadConfidentialMessageProto instead.
 	var messagesStr []string
-	for i := 0; i < len(message.Messages); i++ {
-		messagesStr = append(messagesStr, string(message.Messages[i]))
+	var notes []string
+	for _, message := range messages {
+		messagesStr = append(messagesStr, string(message.Envelope.Ciphertext))
+		notes = append(notes, message.Envelope.Note)
 	}
 
 	resMessages := ReturnMessages{
 		Messages: messagesStr,
-		Notes:    message.Notes,
+		Notes:    notes,
 	}
 
 	return &resMessages, nil
 }
 
+// ReadConfidentialMessageProto is the binary-safe counterpart of ReadConfidentialMessage:
+// it gathers the thread's stored envelopes into a ThreadState and returns its proto encoding, so clients carrying
+// non-UTF-8 ciphertext don't have to round-trip it through a JSON string.
+func (s *SmartContract) ReadConfidentialMessageProto(ctx contractapi.TransactionContextInterface, sender string, receiver string) ([]byte, error) {
+	// Get the MSP ID of submitting client identity
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if receiver+"MSP" != clientMSPID {
+		return nil, fmt.Errorf("receiver and client MSPID is not match")
+	}
+
+	messages, _, err := loadMessages(ctx, sender, receiver, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("there is no messgae to %s in %s", receiver, sender+"MSPCollection")
+	}
+
+	thread := &pb.ThreadState{Sender: sender, Receiver: receiver}
+	for _, message := range messages {
+		thread.Envelopes = append(thread.Envelopes, message.Envelope)
+	}
+
+	threadAsBytes, err := protolib.Marshal(thread)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal thread state: %v", err)
+	}
+
+	return threadAsBytes, nil
+}
+
 // MessageNoticeExists returns true when messageNotice with given ID exists in world state
 func (s *SmartContract) MessageNoticeExists(ctx contractapi.TransactionContextInterface, key string) (bool, error) {
 	messageNoticeJSON, err := ctx.GetStub().GetState(key)
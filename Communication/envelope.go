@@ -0,0 +1,75 @@
+package Communication
+
+import (
+	"encoding/json"
+	"fmt"
+
+	protolib "github.com/golang/protobuf/proto"
+
+	pb "Chaincode/proto"
+)
+
+// CurrentEnvelopeVersion是本合约当前写出去的envelope版本号，
+// 之所以从1开始而不是0，是因为0被用来标记"这是从旧的JSON记录迁移过来的，本来没有版本号"
+const CurrentEnvelopeVersion = 1
+
+// decodeEnvelope把GetTransient()["message"]里的字节解成*pb.Envelope。
+// 新客户端传protobuf编码的Envelope；老客户端仍然可能传老的JSON格式的ConfidentialMessageBySender，
+// 这里用首字节是不是'{'粗略区分两种格式，命中JSON就按老格式解，再搬进Envelope里，version留0
+func decodeEnvelope(data []byte) (*pb.Envelope, error) {
+	if len(data) > 0 && data[0] == '{' {
+		var legacy ConfidentialMessageBySender
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal legacy JSON message: %v", err)
+		}
+		return &pb.Envelope{
+			Version:   0,
+			Sender:    legacy.Sender,
+			Receivers: legacy.Receivers,
+			Ciphertext: legacy.Message,
+			Note:      legacy.Note,
+		}, nil
+	}
+
+	envelope := &pb.Envelope{}
+	if err := protolib.Unmarshal(data, envelope); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proto envelope: %v", err)
+	}
+	if envelope.Version == 0 {
+		return nil, fmt.Errorf("envelope version must be set to %d or higher", CurrentEnvelopeVersion)
+	}
+	return envelope, nil
+}
+
+// decodeThreadState把私有数据里存的一条(sender,receiver)记录解成*pb.ThreadState。
+// 同样兼容老的MessageForReceiver JSON记录：把它的Messages/Notes拆成一组version=0的Envelope
+func decodeThreadState(sender string, receiver string, data []byte) (*pb.ThreadState, error) {
+	if data == nil {
+		return &pb.ThreadState{Sender: sender, Receiver: receiver}, nil
+	}
+
+	if len(data) > 0 && data[0] == '{' {
+		var legacy MessageForReceiver
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal legacy JSON thread: %v", err)
+		}
+
+		envelopes := make([]*pb.Envelope, 0, len(legacy.Messages))
+		for i := 0; i < len(legacy.Messages); i++ {
+			envelopes = append(envelopes, &pb.Envelope{
+				Version:    0,
+				Sender:     legacy.Sender,
+				Receivers:  []string{legacy.Receiver},
+				Ciphertext: legacy.Messages[i],
+				Note:       legacy.Notes[i],
+			})
+		}
+		return &pb.ThreadState{Sender: legacy.Sender, Receiver: legacy.Receiver, Envelopes: envelopes}, nil
+	}
+
+	threadState := &pb.ThreadState{}
+	if err := protolib.Unmarshal(data, threadState); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proto thread state: %v", err)
+	}
+	return threadState, nil
+}
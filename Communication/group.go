@@ -0,0 +1,540 @@
+package Communication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// grpCollection是所有group正文消息共用的私有数据集合，成员组织都需要被加入到它的背书/读取策略里
+const grpCollection = "grpCollection"
+
+// Group保存在world state里（而不是私有数据里），因为成员列表本身不是敏感内容，
+// 需要让所有相关组织都能读到来判断自己是不是群成员、群消息要解密给谁看
+type Group struct {
+	GroupID string   `json:"groupID"`
+	Members []string `json:"members"`
+	Admins  []string `json:"admins"`
+	Epoch   uint64   `json:"epoch"`
+}
+
+// GroupMessage是存进grpCollection里的一条群消息正文，用sender key对称加密，
+// Epoch记录发送时group所处的epoch，便于ReadGroupMessages和成员校验消息是用哪一代sender key加密的
+type GroupMessage struct {
+	GroupID string `json:"groupID"`
+	Sender  string `json:"sender"`
+	Epoch   uint64 `json:"epoch"`
+	Seq     uint64 `json:"seq"`
+	Message []byte `json:"message"`
+}
+
+// SenderKeyDistribution是sender在群成员变动后重新分发sender key时，
+// 发给某一个成员的、用该成员X25519公钥加密过的SKDM，存在sender自己的私有数据集合里
+type SenderKeyDistribution struct {
+	GroupID string `json:"groupID"`
+	Sender  string `json:"sender"`
+	Member  string `json:"member"`
+	Epoch   uint64 `json:"epoch"`
+	Message []byte `json:"message"`
+}
+
+// objectType用"group"而不是"grp"，避免和下面noticeKindGroup="grp"的通知组合键撞在一起：
+// 两者字段数不同，但如果groupID恰好等于某个receiver，partial key scan会把group记录本身也扫进去
+func groupKey(ctx contractapi.TransactionContextInterface, groupID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("group", []string{groupID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+func getGroup(ctx contractapi.TransactionContextInterface, groupID string) (*Group, error) {
+	key, err := groupKey(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	groupBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read group: %s", err.Error())
+	}
+	if groupBytes == nil {
+		return nil, fmt.Errorf("group %s does not exist", groupID)
+	}
+
+	var group Group
+	if err := json.Unmarshal(groupBytes, &group); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal group: %v", err)
+	}
+	return &group, nil
+}
+
+func putGroup(ctx contractapi.TransactionContextInterface, group *Group) error {
+	key, err := groupKey(ctx, group.GroupID)
+	if err != nil {
+		return err
+	}
+
+	groupJSON, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, groupJSON)
+}
+
+func isMember(members []string, identity string) bool {
+	for _, m := range members {
+		if m == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCallerIsAdmin检查调用者声明的identity既是客户端真实MSP身份，又在群的admin列表中
+func verifyCallerIsAdmin(ctx contractapi.TransactionContextInterface, group *Group, caller string) error {
+	if err := verifyIdentityOwnership(ctx, caller); err != nil {
+		return err
+	}
+	if !isMember(group.Members, caller) {
+		return fmt.Errorf("%s is not a member of group %s", caller, group.GroupID)
+	}
+	if !isMember(group.Admins, caller) {
+		return fmt.Errorf("%s is not an admin of group %s", caller, group.GroupID)
+	}
+	return nil
+}
+
+// CreateGroup由创建者发起，创建者自动成为第一个admin和member，初始epoch为1
+func (s *SmartContract) CreateGroup(ctx contractapi.TransactionContextInterface, groupID string, creator string, members []string) error {
+	if len(groupID) == 0 {
+		return fmt.Errorf("groupID field must be a non-empty string")
+	}
+	if err := verifyIdentityOwnership(ctx, creator); err != nil {
+		return fmt.Errorf("CreateGroup cannot be performed: %v", err)
+	}
+
+	key, err := groupKey(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read group: %s", err.Error())
+	}
+	if existing != nil {
+		return fmt.Errorf("group %s already exists", groupID)
+	}
+
+	if !isMember(members, creator) {
+		members = append(members, creator)
+	}
+
+	group := &Group{
+		GroupID: groupID,
+		Members: members,
+		Admins:  []string{creator},
+		Epoch:   1,
+	}
+
+	return putGroup(ctx, group)
+}
+
+// AddMember把新成员加进群，并把epoch向前推进一代，
+// 推进epoch是为了强制sender在下一次SendGroupMessage之前重新分发sender key给所有成员，
+// 这样新成员看不到旧消息，被移除的成员也看不到以后的消息
+func (s *SmartContract) AddMember(ctx contractapi.TransactionContextInterface, groupID string, caller string, member string) error {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if err := verifyCallerIsAdmin(ctx, group, caller); err != nil {
+		return fmt.Errorf("AddMember cannot be performed: %v", err)
+	}
+	if isMember(group.Members, member) {
+		return fmt.Errorf("%s is already a member of group %s", member, groupID)
+	}
+
+	group.Members = append(group.Members, member)
+	group.Epoch++
+
+	return putGroup(ctx, group)
+}
+
+// RemoveMember把成员从群里移除，同样推进epoch
+func (s *SmartContract) RemoveMember(ctx contractapi.TransactionContextInterface, groupID string, caller string, member string) error {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if err := verifyCallerIsAdmin(ctx, group, caller); err != nil {
+		return fmt.Errorf("RemoveMember cannot be performed: %v", err)
+	}
+
+	remaining := make([]string, 0, len(group.Members))
+	found := false
+	for _, m := range group.Members {
+		if m == member {
+			found = true
+			continue
+		}
+		remaining = append(remaining, m)
+	}
+	if !found {
+		return fmt.Errorf("%s is not a member of group %s", member, groupID)
+	}
+
+	group.Members = remaining
+
+	// 被移除的成员不应该继续留在admin列表里，否则它虽然不再是member，却还能调用
+	// AddMember/RemoveMember把自己加回来或者踢掉别人
+	remainingAdmins := make([]string, 0, len(group.Admins))
+	for _, a := range group.Admins {
+		if a == member {
+			continue
+		}
+		remainingAdmins = append(remainingAdmins, a)
+	}
+	group.Admins = remainingAdmins
+
+	group.Epoch++
+
+	return putGroup(ctx, group)
+}
+
+// DistributeSenderKey是sender在成员变动之后，给仍然留在群里的每个成员发一条SKDM，
+// 存在sender自己的私有数据集合里（复用1:1消息的<identity>MSPCollection命名约定），
+// 只有收到了本epoch的SKDM，后面的SendGroupMessage才会被接受
+func (s *SmartContract) DistributeSenderKey(ctx contractapi.TransactionContextInterface, groupID string, sender string, member string, encryptedSenderKey []byte) error {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if err := verifyIdentityOwnership(ctx, sender); err != nil {
+		return fmt.Errorf("DistributeSenderKey cannot be performed: %v", err)
+	}
+	if !isMember(group.Members, sender) {
+		return fmt.Errorf("%s is not a member of group %s", sender, groupID)
+	}
+	if !isMember(group.Members, member) {
+		return fmt.Errorf("%s is not a member of group %s", member, groupID)
+	}
+
+	skdm := SenderKeyDistribution{
+		GroupID: groupID,
+		Sender:  sender,
+		Member:  member,
+		Epoch:   group.Epoch,
+		Message: encryptedSenderKey,
+	}
+	skdmJSON, err := json.Marshal(skdm)
+	if err != nil {
+		return err
+	}
+
+	skdmKey, err := ctx.GetStub().CreateCompositeKey("skdm", []string{groupID, member, sender})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+
+	if err := ctx.GetStub().PutPrivateData(sender+"MSPCollection", skdmKey, skdmJSON); err != nil {
+		return fmt.Errorf("failed to put SKDM: %s", err.Error())
+	}
+
+	// skdmSentKey和skdmKey是分开的两条记录：skdmKey会在member通过ReadGroupMessages领取之后被删掉，
+	// 如果MarkSenderKeyDistributed也去查skdmKey，member一领取完sender反而验证不过了；
+	// skdmSentKey专门留给MarkSenderKeyDistributed核对"这个epoch确实给这个member发过"，不会被领取删除
+	sentKey, err := skdmSentKey(ctx, groupID, sender, member)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutPrivateData(sender+"MSPCollection", sentKey, []byte(fmt.Sprintf("%d", group.Epoch))); err != nil {
+		return fmt.Errorf("failed to put SKDM sent marker: %s", err.Error())
+	}
+
+	return s.CreateNotice(ctx, member, sender, noticeKindSKDM)
+}
+
+// skdmSentKey是DistributeSenderKey给每个member留下的"本epoch已发送"标记的key，
+// 和会被领取删除的skdmKey分开存放，供MarkSenderKeyDistributed核实分发是否真的齐全
+func skdmSentKey(ctx contractapi.TransactionContextInterface, groupID string, sender string, member string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("skdmsent", []string{groupID, sender, member})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// senderEpochKey记录某个sender上一次给全部当前成员都分发完sender key时，群所处的epoch，
+// SendGroupMessage据此判断sender是否已经完成了本代成员变动后的重新分发
+func senderEpochKey(ctx contractapi.TransactionContextInterface, groupID string, sender string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("grpsk", []string{groupID, sender})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// MarkSenderKeyDistributed由sender在给所有当前成员都发完SKDM之后调用一次，
+// 记录本epoch分发完成，这样SendGroupMessage就不用逐个成员去扫SKDM是否齐全。
+// 这里会先逐个成员核实skdmSentKey，防止sender在一个SKDM都没发的情况下直接调用本方法
+// 把grpsk标记推成最新epoch，导致被踢出/新加入的成员拿不到sender key却还能被SendGroupMessage放行
+func (s *SmartContract) MarkSenderKeyDistributed(ctx contractapi.TransactionContextInterface, groupID string, sender string) error {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if err := verifyIdentityOwnership(ctx, sender); err != nil {
+		return fmt.Errorf("MarkSenderKeyDistributed cannot be performed: %v", err)
+	}
+
+	for _, member := range group.Members {
+		if member == sender {
+			continue
+		}
+
+		sentKey, err := skdmSentKey(ctx, groupID, sender, member)
+		if err != nil {
+			return err
+		}
+		sentBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", sentKey)
+		if err != nil {
+			return fmt.Errorf("failed to read SKDM sent marker: %s", err.Error())
+		}
+
+		var sentEpoch uint64
+		if sentBytes != nil {
+			fmt.Sscanf(string(sentBytes), "%d", &sentEpoch)
+		}
+		if sentBytes == nil || sentEpoch != group.Epoch {
+			return fmt.Errorf("sender %s has not distributed the epoch %d sender key to member %s yet", sender, group.Epoch, member)
+		}
+	}
+
+	key, err := senderEpochKey(ctx, groupID, sender)
+	if err != nil {
+		return err
+	}
+
+	epochBytes := []byte(fmt.Sprintf("%d", group.Epoch))
+	return ctx.GetStub().PutState(key, epochBytes)
+}
+
+// SendGroupMessage要求sender已经给当前epoch的成员都分发过sender key，否则拒绝发送，
+// 防止新成员变动后sender忘记重新分发、导致部分成员用旧的sender key解不开新消息却还被静默接受
+func (s *SmartContract) SendGroupMessage(ctx contractapi.TransactionContextInterface, groupID string, sender string, message []byte) (uint64, error) {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return 0, err
+	}
+	if err := verifyIdentityOwnership(ctx, sender); err != nil {
+		return 0, fmt.Errorf("SendGroupMessage cannot be performed: %v", err)
+	}
+	if !isMember(group.Members, sender) {
+		return 0, fmt.Errorf("%s is not a member of group %s", sender, groupID)
+	}
+
+	key, err := senderEpochKey(ctx, groupID, sender)
+	if err != nil {
+		return 0, err
+	}
+	distributedEpochBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read sender key distribution state: %s", err.Error())
+	}
+	distributedEpoch := uint64(0)
+	if distributedEpochBytes != nil {
+		fmt.Sscanf(string(distributedEpochBytes), "%d", &distributedEpoch)
+	}
+	if distributedEpoch != group.Epoch {
+		return 0, fmt.Errorf("sender key for group %s epoch %d has not been distributed to all members yet", groupID, group.Epoch)
+	}
+
+	seqKey, err := ctx.GetStub().CreateCompositeKey("grpseq", []string{groupID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	// grpseq存在grpCollection这个私有数据集合里，而不是world state，
+	// 避免不在群里的组织也能通过这个计数器观察到某个群的消息量和发送频率，
+	// 和chunk0-4把1:1 thread计数器挪进sender私有集合是同样的考虑
+	seqBytes, err := ctx.GetStub().GetPrivateData(grpCollection, seqKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read group sequence: %s", err.Error())
+	}
+	var seq uint64
+	if seqBytes != nil {
+		fmt.Sscanf(string(seqBytes), "%d", &seq)
+	}
+	seq++
+
+	groupMessage := GroupMessage{
+		GroupID: groupID,
+		Sender:  sender,
+		Epoch:   group.Epoch,
+		Seq:     seq,
+		Message: message,
+	}
+	groupMessageJSON, err := json.Marshal(groupMessage)
+	if err != nil {
+		return 0, err
+	}
+
+	msgKey, err := ctx.GetStub().CreateCompositeKey("grpmsg", []string{groupID, fmt.Sprintf(seqKeyWidth, seq)})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	if err := ctx.GetStub().PutPrivateData(grpCollection, msgKey, groupMessageJSON); err != nil {
+		return 0, fmt.Errorf("failed to put group message: %s", err.Error())
+	}
+	if err := ctx.GetStub().PutPrivateData(grpCollection, seqKey, []byte(fmt.Sprintf("%d", seq))); err != nil {
+		return 0, fmt.Errorf("failed to put group sequence: %s", err.Error())
+	}
+
+	for _, member := range group.Members {
+		if member == sender {
+			continue
+		}
+		if err := s.CreateNotice(ctx, member, sender, noticeKindGroup); err != nil {
+			return 0, fmt.Errorf("failed to create group message notice: %s", err.Error())
+		}
+	}
+
+	return seq, nil
+}
+
+// GroupRead是ReadGroupMessages的返回值。contractapi生成链码元数据时只允许一个非error
+// 返回值，所以不能像原来那样直接返回(messages, skdms, error)两个切片
+type GroupRead struct {
+	Messages []GroupMessage           `json:"messages"`
+	SKDMs    []SenderKeyDistribution `json:"skdms"`
+}
+
+// ReadGroupMessages给调用者返回group正文消息，以及所有发给调用者、还没被领取的SKDM；
+// 调用者必须是群成员，SKDM读取之后会被删除，代表已经被成功领取（客户端拿到即可派生sender key）
+func (s *SmartContract) ReadGroupMessages(ctx contractapi.TransactionContextInterface, groupID string, caller string) (*GroupRead, error) {
+	group, err := getGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyIdentityOwnership(ctx, caller); err != nil {
+		return nil, fmt.Errorf("ReadGroupMessages cannot be performed: %v", err)
+	}
+	if !isMember(group.Members, caller) {
+		return nil, fmt.Errorf("%s is not a member of group %s", caller, groupID)
+	}
+
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(grpCollection, "grpmsg", []string{groupID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query group messages: %s", err.Error())
+	}
+	defer iterator.Close()
+
+	var messages []GroupMessage
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var groupMessage GroupMessage
+		if err := json.Unmarshal(item.Value, &groupMessage); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal group message: %v", err)
+		}
+		messages = append(messages, groupMessage)
+	}
+
+	var skdms []SenderKeyDistribution
+	for _, sender := range group.Members {
+		if sender == caller {
+			continue
+		}
+		skdmKey, err := ctx.GetStub().CreateCompositeKey("skdm", []string{groupID, caller, sender})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key: %s", err.Error())
+		}
+		skdmBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", skdmKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SKDM: %s", err.Error())
+		}
+		if skdmBytes == nil {
+			continue
+		}
+		var skdm SenderKeyDistribution
+		if err := json.Unmarshal(skdmBytes, &skdm); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal SKDM: %v", err)
+		}
+		skdms = append(skdms, skdm)
+
+		if err := ctx.GetStub().DelPrivateData(sender+"MSPCollection", skdmKey); err != nil {
+			return nil, fmt.Errorf("failed to delete claimed SKDM: %s", err.Error())
+		}
+	}
+
+	return &GroupRead{Messages: messages, SKDMs: skdms}, nil
+}
+
+// noticeExistsValue是CreateNotice/ReadNotice共用的"1"标记，和CreateMessageNotice历史上用的值保持一致
+var noticeExistsValue = []byte("1")
+var noticeReadValue = []byte("0")
+
+const (
+	noticeKindMessage = "mn"
+	noticeKindGroup   = "grp"
+	noticeKindSKDM    = "skdm"
+)
+
+// CreateNotice是CreateMessageNotice的通用化版本，多了一个kind区分通知类型（"mn"/"grp"/"skdm"），
+// 订阅者可以只轮询自己关心的kind而不用把所有通知都拉下来再过滤
+func (s *SmartContract) CreateNotice(ctx contractapi.TransactionContextInterface, receiver string, sender string, kind string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(kind, []string{receiver, sender})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+
+	noticeBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read notice: %s", err.Error())
+	}
+	if bytes.Equal(noticeBytes, noticeExistsValue) {
+		return nil
+	}
+
+	return ctx.GetStub().PutState(key, noticeExistsValue)
+}
+
+// ReadNotice是ReadMessageNotice的通用化版本，按kind过滤，语义和原函数完全一致：
+// 未读的通知返回sender并翻转为已读，已读的通知也照样返回sender（假设后端没有落盘已读消息）
+func (s *SmartContract) ReadNotice(ctx contractapi.TransactionContextInterface, receiver string, kind string) ([]string, error) {
+	rs, err := ctx.GetStub().GetStateByPartialCompositeKey(kind, []string{receiver})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	defer rs.Close()
+
+	var senders []string
+	for rs.HasNext() {
+		item, err := rs.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %s", err.Error())
+		}
+		sender := keyParts[1]
+		senders = append(senders, sender)
+
+		if bytes.Equal(item.Value, noticeExistsValue) {
+			key, err := ctx.GetStub().CreateCompositeKey(kind, []string{receiver, sender})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create composite key: %s", err.Error())
+			}
+			if err := ctx.GetStub().PutState(key, noticeReadValue); err != nil {
+				return nil, fmt.Errorf("failed to put value: %s", err.Error())
+			}
+		}
+	}
+	return senders, nil
+}
@@ -0,0 +1,298 @@
+package Communication
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// 最小轮换间隔（纳秒），用于RotatePreKeys的限速，防止恶意或故障客户端反复刷新prekey导致状态膨胀
+const minRotateIntervalNs = int64(60) * 1e9
+
+// IdentityBundle是某个identity在KeyDirectory中登记的身份信息：
+// 长期身份公钥（Ed25519）、签名的X25519 prekey及其签名、密钥epoch，以及是否已被吊销
+type IdentityBundle struct {
+	IdentityKeyPub   []byte `json:"identityKeyPub"`
+	SignedPreKeyPub  []byte `json:"signedPreKeyPub"`
+	SignedPreKeySig  []byte `json:"signedPreKeySig"`
+	Epoch            uint64 `json:"epoch"`
+	LastRotateNs     int64  `json:"lastRotateNs"`
+	Revoked          bool   `json:"revoked"`
+}
+
+// PreKeyBundle是FetchPreKeyBundle返回给发送方的数据，包含X3DH所需的全部公开材料，
+// 以及本次消费掉的one-time prekey的ID（可能为空，代表receiver已经没有one-time prekey了）
+type PreKeyBundle struct {
+	IdentityKeyPub  []byte `json:"identityKeyPub"`
+	SignedPreKeyPub []byte `json:"signedPreKeyPub"`
+	SignedPreKeySig []byte `json:"signedPreKeySig"`
+	Epoch           uint64 `json:"epoch"`
+	OneTimePreKeyID string `json:"oneTimePreKeyId"`
+	OneTimePreKey   []byte `json:"oneTimePreKey"`
+}
+
+// KeyDirectory与SmartContract并列，专门负责X3DH身份/prekey目录的维护，
+// 不涉及任何消息内容，消息内容仍然由SmartContract的私有数据集合保存
+type KeyDirectory struct {
+	contractapi.Contract
+}
+
+func identityKey(ctx contractapi.TransactionContextInterface, identity string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("idk", []string{identity})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+func oneTimePreKeyKey(ctx contractapi.TransactionContextInterface, identity string, preKeyID string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("otpk", []string{identity, preKeyID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// verifyIdentityOwnership确保调用者的客户端MSPID与它声明的identity一致，
+// 和CreateConfidentialMessageBySender里对sender做的检查保持同样的约定
+func verifyIdentityOwnership(ctx contractapi.TransactionContextInterface, identity string) error {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if identity+"MSP" != clientMSPID {
+		return fmt.Errorf("identity %s and client MSPID %s is not match", identity, clientMSPID)
+	}
+	return nil
+}
+
+// RegisterIdentity登记一个identity的长期身份公钥以及初始的signed prekey，
+// 只能由该identity自己的组织调用，已登记的identity再次调用会被拒绝（刷新prekey、推进epoch要用RotatePreKeys）
+func (k *KeyDirectory) RegisterIdentity(ctx contractapi.TransactionContextInterface, identity string, identityKeyPub []byte, signedPreKeyPub []byte, signedPreKeySig []byte) error {
+	if len(identityKeyPub) == 0 || len(signedPreKeyPub) == 0 || len(signedPreKeySig) == 0 {
+		return fmt.Errorf("identityKeyPub, signedPreKeyPub and signedPreKeySig must be non-empty")
+	}
+
+	if err := verifyIdentityOwnership(ctx, identity); err != nil {
+		return fmt.Errorf("RegisterIdentity cannot be performed: %v", err)
+	}
+
+	key, err := identityKey(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	existingBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read identity bundle: %s", err.Error())
+	}
+	if existingBytes != nil {
+		return fmt.Errorf("identity %s is already registered, use RotatePreKeys to refresh its prekey", identity)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get tx timestamp: %s", err.Error())
+	}
+
+	bundle := IdentityBundle{
+		IdentityKeyPub:  identityKeyPub,
+		SignedPreKeyPub: signedPreKeyPub,
+		SignedPreKeySig: signedPreKeySig,
+		Epoch:           1,
+		LastRotateNs:    txTimestamp.AsTime().UnixNano(),
+		Revoked:         false,
+	}
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, bundleJSON)
+}
+
+// AddOneTimePreKeys向identity的one-time prekey池中追加若干把公钥，每把都必须带唯一ID，
+// 已存在的ID会被拒绝，避免FetchPreKeyBundle消费到一把被悄悄替换过的prekey
+func (k *KeyDirectory) AddOneTimePreKeys(ctx contractapi.TransactionContextInterface, identity string, preKeyIDs []string, preKeyPubs [][]byte) error {
+	if len(preKeyIDs) == 0 || len(preKeyIDs) != len(preKeyPubs) {
+		return fmt.Errorf("preKeyIDs and preKeyPubs must be non-empty and of equal length")
+	}
+
+	if err := verifyIdentityOwnership(ctx, identity); err != nil {
+		return fmt.Errorf("AddOneTimePreKeys cannot be performed: %v", err)
+	}
+
+	for i := 0; i < len(preKeyIDs); i++ {
+		key, err := oneTimePreKeyKey(ctx, identity, preKeyIDs[i])
+		if err != nil {
+			return err
+		}
+
+		existing, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return fmt.Errorf("failed to read one-time prekey: %s", err.Error())
+		}
+		if existing != nil {
+			return fmt.Errorf("one-time prekey %s already exists for identity %s", preKeyIDs[i], identity)
+		}
+
+		if err := ctx.GetStub().PutState(key, preKeyPubs[i]); err != nil {
+			return fmt.Errorf("failed to put one-time prekey: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// FetchPreKeyBundle是发送方发起X3DH的起点：取出receiver登记的身份/签名prekey，
+// 再顺带消费一把one-time prekey（若还有剩余），消费后立即从world state删除，
+// 保证同一把one-time prekey不会被两个并发的FetchPreKeyBundle拿到两次
+func (k *KeyDirectory) FetchPreKeyBundle(ctx contractapi.TransactionContextInterface, receiverMSP string, identity string) (*PreKeyBundle, error) {
+	if identity+"MSP" != receiverMSP {
+		return nil, fmt.Errorf("identity %s does not belong to MSP %s", identity, receiverMSP)
+	}
+
+	key, err := identityKey(ctx, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity bundle: %s", err.Error())
+	}
+	if bundleBytes == nil {
+		return nil, fmt.Errorf("identity %s is not registered in the key directory", identity)
+	}
+
+	var bundle IdentityBundle
+	if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal identity bundle: %v", err)
+	}
+	if bundle.Revoked {
+		return nil, fmt.Errorf("identity %s has been revoked", identity)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey("otpk", []string{identity})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query one-time prekeys: %s", err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := &PreKeyBundle{
+		IdentityKeyPub:  bundle.IdentityKeyPub,
+		SignedPreKeyPub: bundle.SignedPreKeyPub,
+		SignedPreKeySig: bundle.SignedPreKeySig,
+		Epoch:           bundle.Epoch,
+	}
+
+	if resultsIterator.HasNext() {
+		item, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %s", err.Error())
+		}
+
+		if err := ctx.GetStub().DelState(item.Key); err != nil {
+			return nil, fmt.Errorf("failed to consume one-time prekey: %s", err.Error())
+		}
+
+		result.OneTimePreKeyID = keyParts[1]
+		result.OneTimePreKey = item.Value
+	}
+
+	return result, nil
+}
+
+// RotatePreKeys用一把新的signed prekey替换旧的，并把epoch单调递增，
+// 通过minRotateIntervalNs做限速，避免客户端异常情况下反复占用world state的写操作
+func (k *KeyDirectory) RotatePreKeys(ctx contractapi.TransactionContextInterface, identity string, signedPreKeyPub []byte, signedPreKeySig []byte) error {
+	if len(signedPreKeyPub) == 0 || len(signedPreKeySig) == 0 {
+		return fmt.Errorf("signedPreKeyPub and signedPreKeySig must be non-empty")
+	}
+
+	if err := verifyIdentityOwnership(ctx, identity); err != nil {
+		return fmt.Errorf("RotatePreKeys cannot be performed: %v", err)
+	}
+
+	key, err := identityKey(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	bundleBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read identity bundle: %s", err.Error())
+	}
+	if bundleBytes == nil {
+		return fmt.Errorf("identity %s is not registered in the key directory", identity)
+	}
+
+	var bundle IdentityBundle
+	if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+		return fmt.Errorf("failed to unmarshal identity bundle: %v", err)
+	}
+	if bundle.Revoked {
+		return fmt.Errorf("identity %s has been revoked", identity)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return fmt.Errorf("failed to get tx timestamp: %s", err.Error())
+	}
+	nowNs := txTimestamp.AsTime().UnixNano()
+	if nowNs-bundle.LastRotateNs < minRotateIntervalNs {
+		return fmt.Errorf("prekey rotation for %s is rate limited, try again later", identity)
+	}
+
+	bundle.SignedPreKeyPub = signedPreKeyPub
+	bundle.SignedPreKeySig = signedPreKeySig
+	bundle.Epoch++
+	bundle.LastRotateNs = nowNs
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, bundleJSON)
+}
+
+// RevokeIdentity标记一个identity已被吊销：之后的FetchPreKeyBundle会直接拒绝，
+// 但已经被其他人消费掉的one-time prekey不会被追溯失效，这是X3DH本身的性质
+func (k *KeyDirectory) RevokeIdentity(ctx contractapi.TransactionContextInterface, identity string) error {
+	if err := verifyIdentityOwnership(ctx, identity); err != nil {
+		return fmt.Errorf("RevokeIdentity cannot be performed: %v", err)
+	}
+
+	key, err := identityKey(ctx, identity)
+	if err != nil {
+		return err
+	}
+
+	bundleBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read identity bundle: %s", err.Error())
+	}
+	if bundleBytes == nil {
+		return fmt.Errorf("identity %s is not registered in the key directory", identity)
+	}
+
+	var bundle IdentityBundle
+	if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+		return fmt.Errorf("failed to unmarshal identity bundle: %v", err)
+	}
+
+	bundle.Revoked = true
+
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(key, bundleJSON)
+}
@@ -0,0 +1,369 @@
+package Communication
+
+import (
+	"fmt"
+
+	protolib "github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+
+	pb "Chaincode/proto"
+)
+
+// seqKeyWidth左补零格式化seq，使得组合键按字典序遍历时和按数值排序是一致的
+const seqKeyWidth = "%020d"
+
+// StoredMessage是分页接口返回给调用方的一条消息，带上了它在thread里的seq号，
+// 方便客户端用AckAndDeleteMessages/下一页请求的afterSeq引用到具体这一条
+type StoredMessage struct {
+	Seq      uint64      `json:"seq"`
+	Envelope *pb.Envelope `json:"envelope"`
+}
+
+// MessagePage是ReadConfidentialMessagePage的返回值。contractapi生成链码元数据时
+// 只允许一个非error返回值，所以不能像内部的loadMessages那样直接返回
+// (messages, nextCursor, error)，把两者包进一个结构体里
+type MessagePage struct {
+	Messages   []StoredMessage `json:"messages"`
+	NextCursor uint64          `json:"nextCursor"`
+	// AutoReceiptError非空代表调用方带了autoReceiptSignature，但自动回执没有成功入账；
+	// 这不会让本次读取失败，调用方看到这个字段自己决定要不要回退成单独调用PostReceipt
+	AutoReceiptError string `json:"autoReceiptError,omitempty"`
+}
+
+func threadMetaKey(ctx contractapi.TransactionContextInterface, sender string, receiver string) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("msgmeta", []string{sender, receiver})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// nextMessageSeq给(sender,receiver)这条thread分配下一个seq号并持久化，
+// seq在一条thread内单调递增、永不重用，即使中间的消息被Ack删除了也不会。
+// 计数器存在sender自己的MSPCollection里而不是公共world state，避免其他组织
+// 通过观察这个计数器就能推算出某个1:1会话的消息量和发送频率
+func nextMessageSeq(ctx contractapi.TransactionContextInterface, sender string, receiver string) (uint64, error) {
+	key, err := threadMetaKey(ctx, sender, receiver)
+	if err != nil {
+		return 0, err
+	}
+
+	metaBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read thread meta: %s", err.Error())
+	}
+
+	var seq uint64
+	if metaBytes != nil {
+		fmt.Sscanf(string(metaBytes), "%d", &seq)
+	}
+	seq++
+
+	if err := ctx.GetStub().PutPrivateData(sender+"MSPCollection", key, []byte(fmt.Sprintf("%d", seq))); err != nil {
+		return 0, fmt.Errorf("failed to put thread meta: %s", err.Error())
+	}
+	return seq, nil
+}
+
+func messageKey(ctx contractapi.TransactionContextInterface, sender string, receiver string, seq uint64) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("msg", []string{sender, receiver, fmt.Sprintf(seqKeyWidth, seq)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// storeMessage把一条envelope写到它自己的("msg", sender, receiver, seq)组合键下，
+// 取代了原来把整条thread序列化成一个大blob再整体读写的方式
+func storeMessage(ctx contractapi.TransactionContextInterface, sender string, receiver string, envelope *pb.Envelope) (uint64, error) {
+	seq, err := nextMessageSeq(ctx, sender, receiver)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := messageKey(ctx, sender, receiver, seq)
+	if err != nil {
+		return 0, err
+	}
+
+	envelopeBytes, err := protolib.Marshal(envelope)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal envelope: %v", err)
+	}
+
+	if err := ctx.GetStub().PutPrivateData(sender+"MSPCollection", key, envelopeBytes); err != nil {
+		return 0, fmt.Errorf("failed to put message: %s", err.Error())
+	}
+	return seq, nil
+}
+
+// migrateLegacyThread是一次性的迁移路径：旧版本把整条thread存成一个平铺的
+// ("sender MSPCollection", receiver) -> ThreadState/MessageForReceiver大blob，
+// 第一次用新的分页接口读到这种thread时，把它拆成每条一个("msg", sender, receiver, seq)键，
+// 然后删掉旧的大blob，后续访问就都走新的存储结构了
+func migrateLegacyThread(ctx contractapi.TransactionContextInterface, sender string, receiver string) (bool, error) {
+	legacyBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", receiver)
+	if err != nil {
+		return false, fmt.Errorf("failed to get message: %s", err.Error())
+	}
+	if legacyBytes == nil {
+		return false, nil
+	}
+
+	thread, err := decodeThreadState(sender, receiver, legacyBytes)
+	if err != nil {
+		return false, err
+	}
+
+	for _, envelope := range thread.Envelopes {
+		if _, err := storeMessage(ctx, sender, receiver, envelope); err != nil {
+			return false, err
+		}
+	}
+
+	if err := ctx.GetStub().DelPrivateData(sender+"MSPCollection", receiver); err != nil {
+		return false, fmt.Errorf("failed to delete legacy thread blob: %s", err.Error())
+	}
+	return true, nil
+}
+
+// peekLegacyThread只读地把旧版单blob格式的thread解成StoredMessage列表，不做任何写操作，
+// 所以loadMessages可以放心在ReadConfidentialMessage/ReadConfidentialMessageProto的
+// evaluateTransaction（只读查询）路径下调用它；真正把这些消息落成新的
+// ("msg", sender, receiver, seq)键、删掉旧blob，需要调用者显式submit MigrateLegacyThread
+func peekLegacyThread(ctx contractapi.TransactionContextInterface, sender string, receiver string) ([]StoredMessage, uint64, error) {
+	legacyBytes, err := ctx.GetStub().GetPrivateData(sender+"MSPCollection", receiver)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get message: %s", err.Error())
+	}
+	if legacyBytes == nil {
+		return nil, 0, nil
+	}
+
+	thread, err := decodeThreadState(sender, receiver, legacyBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var messages []StoredMessage
+	var cursor uint64
+	for i, envelope := range thread.Envelopes {
+		seq := uint64(i + 1)
+		messages = append(messages, StoredMessage{Seq: seq, Envelope: envelope})
+		cursor = seq
+	}
+	return messages, cursor, nil
+}
+
+// loadMessages返回(sender,receiver)thread里seq大于afterSeq的消息，最多limit条（limit<=0表示不限），
+// 以及调用方下次分页应该传入的afterSeq；如果thread还是旧的单blob格式，会只读地把它展开成
+// 临时的StoredMessage列表展示给调用方，不会触发实际迁移（见peekLegacyThread/MigrateLegacyThread）
+func loadMessages(ctx contractapi.TransactionContextInterface, sender string, receiver string, afterSeq uint64, limit int) ([]StoredMessage, uint64, error) {
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(sender+"MSPCollection", "msg", []string{sender, receiver})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query messages: %s", err.Error())
+	}
+
+	var messages []StoredMessage
+	nextCursor := afterSeq
+	sawAny := false
+
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			return nil, 0, err
+		}
+		sawAny = true
+
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			iterator.Close()
+			return nil, 0, fmt.Errorf("failed to split composite key: %s", err.Error())
+		}
+		var seq uint64
+		fmt.Sscanf(keyParts[2], "%d", &seq)
+		if seq <= afterSeq {
+			continue
+		}
+		// keys are zero-padded so the iterator visits seqs in ascending order: once we've
+		// filled the page, every remaining key is also beyond it, so stop scanning instead
+		// of unmarshalling envelopes we're about to throw away
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+
+		envelope := &pb.Envelope{}
+		if err := protolib.Unmarshal(item.Value, envelope); err != nil {
+			iterator.Close()
+			return nil, 0, fmt.Errorf("failed to unmarshal envelope: %v", err)
+		}
+
+		messages = append(messages, StoredMessage{Seq: seq, Envelope: envelope})
+		nextCursor = seq
+	}
+	iterator.Close()
+
+	if !sawAny {
+		legacyMessages, _, err := peekLegacyThread(ctx, sender, receiver)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, message := range legacyMessages {
+			if message.Seq <= afterSeq {
+				continue
+			}
+			if limit > 0 && len(messages) >= limit {
+				break
+			}
+			messages = append(messages, message)
+			nextCursor = message.Seq
+		}
+	}
+
+	return messages, nextCursor, nil
+}
+
+// MigrateLegacyThread是migrateLegacyThread的显式submit-only入口。读路径
+// （ReadConfidentialMessage/ReadConfidentialMessageProto/ReadConfidentialMessagePage）
+// 通常通过evaluateTransaction调用，写操作在evaluate下会被模拟掉、从不落盘，
+// 所以真正把旧blob拆成按seq存储的新格式、并删掉旧blob，必须由客户端显式submit这个方法
+func (s *SmartContract) MigrateLegacyThread(ctx contractapi.TransactionContextInterface, sender string, receiver string) (bool, error) {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return false, fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if receiver+"MSP" != clientMSPID {
+		return false, fmt.Errorf("receiver and client MSPID is not match")
+	}
+
+	migrated, err := migrateLegacyThread(ctx, sender, receiver)
+	if err != nil {
+		return false, fmt.Errorf("MigrateLegacyThread cannot be performed: %v", err)
+	}
+	return migrated, nil
+}
+
+// ReadConfidentialMessagePage是ReadConfidentialMessage的分页版本：receiver每次传上一页返回的
+// nextCursor作为afterSeq，直到返回的消息数量小于限制，就说明读到最新了。
+//
+// autoReceiptSignature是可选的：如果非空，receiver在同一笔交易里顺带对autoReceiptUpToSeq
+// 提交一个DELIVERED回执，省掉再单独调一次PostReceipt的往返。autoReceiptUpToSeq由调用方
+// 在发起这次读取之前自己决定并签名，不依赖本次页面实际读到了什么——nextCursor要等
+// loadMessages跑完才知道，receiver不可能提前对它签名，绑定到页面内容会导致第一次/
+// 往前翻页时签名永远对不上。签名校验和PostReceipt完全一样，所以autoReceiptTimestampNs
+// 必须是receiver签名时用的那个时间戳。
+// 自动回执失败（比如签名对不上）不会让这次读取跟着失败，只会体现在返回的
+// AutoReceiptError里，调用方可以选择忽略或者自己回退去调PostReceipt
+func (s *SmartContract) ReadConfidentialMessagePage(ctx contractapi.TransactionContextInterface, sender string, receiver string, afterSeq uint64, limit int, autoReceiptUpToSeq uint64, autoReceiptTimestampNs int64, autoReceiptSignature []byte) (*MessagePage, error) {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if receiver+"MSP" != clientMSPID {
+		return nil, fmt.Errorf("receiver and client MSPID is not match")
+	}
+
+	messages, nextCursor, err := loadMessages(ctx, sender, receiver, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{Messages: messages, NextCursor: nextCursor}
+
+	if len(autoReceiptSignature) > 0 {
+		if err := putReceipt(ctx, sender, receiver, autoReceiptUpToSeq, ReceiptStatusDelivered, autoReceiptTimestampNs, autoReceiptSignature); err != nil {
+			page.AutoReceiptError = fmt.Sprintf("failed to auto-post delivery receipt: %v", err)
+		}
+	}
+
+	return page, nil
+}
+
+// AckAndDeleteMessages由receiver在把消息持久化到链下之后调用，把seq不超过upToSeq的消息
+// 从私有数据集合里删掉，让thread的私有数据占用不会无限增长
+func (s *SmartContract) AckAndDeleteMessages(ctx contractapi.TransactionContextInterface, sender string, receiver string, upToSeq uint64) error {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if receiver+"MSP" != clientMSPID {
+		return fmt.Errorf("receiver and client MSPID is not match")
+	}
+
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(sender+"MSPCollection", "msg", []string{sender, receiver})
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %s", err.Error())
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+
+		_, keyParts, err := ctx.GetStub().SplitCompositeKey(item.Key)
+		if err != nil {
+			return fmt.Errorf("failed to split composite key: %s", err.Error())
+		}
+		var seq uint64
+		fmt.Sscanf(keyParts[2], "%d", &seq)
+		// keys are zero-padded so they're visited in ascending seq order: once we're past
+		// upToSeq every remaining key is too, so stop instead of scanning the whole thread
+		if seq > upToSeq {
+			break
+		}
+
+		if err := ctx.GetStub().DelPrivateData(sender+"MSPCollection", item.Key); err != nil {
+			return fmt.Errorf("failed to delete message: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// PurgeExpired清理(sender,receiver)thread里ExpiresAtNs已过期的消息，sender和receiver任一方都可以调用，
+// 这是为了处理receiver一直不来Ack的情况，避免带TTL的消息永远占着私有数据空间
+func (s *SmartContract) PurgeExpired(ctx contractapi.TransactionContextInterface, sender string, receiver string) (int, error) {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if sender+"MSP" != clientMSPID && receiver+"MSP" != clientMSPID {
+		return 0, fmt.Errorf("caller's client MSPID %s is neither the sender nor the receiver of this thread", clientMSPID)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get tx timestamp: %s", err.Error())
+	}
+	nowNs := txTimestamp.AsTime().UnixNano()
+
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(sender+"MSPCollection", "msg", []string{sender, receiver})
+	if err != nil {
+		return 0, fmt.Errorf("failed to query messages: %s", err.Error())
+	}
+	defer iterator.Close()
+
+	purged := 0
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return purged, err
+		}
+
+		envelope := &pb.Envelope{}
+		if err := protolib.Unmarshal(item.Value, envelope); err != nil {
+			return purged, fmt.Errorf("failed to unmarshal envelope: %v", err)
+		}
+		if envelope.ExpiresAtNs == 0 || envelope.ExpiresAtNs > nowNs {
+			continue
+		}
+
+		if err := ctx.GetStub().DelPrivateData(sender+"MSPCollection", item.Key); err != nil {
+			return purged, fmt.Errorf("failed to delete expired message: %s", err.Error())
+		}
+		purged++
+	}
+	return purged, nil
+}
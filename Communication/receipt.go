@@ -0,0 +1,165 @@
+package Communication
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// rcptCollection保存消息回执，需要配置成sender和receiver两个组织都能读的私有数据集合策略，
+// 这点和grpCollection/<identity>MSPCollection只给单一组织读是不一样的
+const rcptCollection = "rcptCollection"
+
+const (
+	ReceiptStatusDelivered = "DELIVERED"
+	ReceiptStatusRead      = "READ"
+	ReceiptStatusFailed    = "FAILED"
+)
+
+// Receipt是一条消息的送达/已读/失败回执，Signature是receiver对
+// (sender, receiver, seq, status, timestampNs)的ed25519签名，
+// 用receiver在KeyDirectory里登记的身份公钥验证，这样sender拿到的回执是不可抵赖的
+type Receipt struct {
+	Sender      string `json:"sender"`
+	Receiver    string `json:"receiver"`
+	Seq         uint64 `json:"seq"`
+	Status      string `json:"status"`
+	TimestampNs int64  `json:"timestampNs"`
+	Signature   []byte `json:"signature"`
+}
+
+func receiptKey(ctx contractapi.TransactionContextInterface, sender string, receiver string, seq uint64) (string, error) {
+	key, err := ctx.GetStub().CreateCompositeKey("rcpt", []string{sender, receiver, fmt.Sprintf(seqKeyWidth, seq)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %s", err.Error())
+	}
+	return key, nil
+}
+
+// receiptSignedBytes是receipt签名覆盖的明文，字段顺序和分隔符必须和客户端签名时用的一致
+func receiptSignedBytes(sender string, receiver string, seq uint64, status string, timestampNs int64) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%d|%s|%d", sender, receiver, seq, status, timestampNs))
+}
+
+// verifyReceiptSignature从KeyDirectory取出receiver登记的身份公钥，校验这条回执确实是receiver签的
+func verifyReceiptSignature(ctx contractapi.TransactionContextInterface, sender string, receiver string, seq uint64, status string, timestampNs int64, signature []byte) error {
+	key, err := identityKey(ctx, receiver)
+	if err != nil {
+		return err
+	}
+
+	bundleBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read identity bundle: %s", err.Error())
+	}
+	if bundleBytes == nil {
+		return fmt.Errorf("receiver %s has no identity registered in the key directory", receiver)
+	}
+
+	var bundle IdentityBundle
+	if err := json.Unmarshal(bundleBytes, &bundle); err != nil {
+		return fmt.Errorf("failed to unmarshal identity bundle: %v", err)
+	}
+	if bundle.Revoked {
+		return fmt.Errorf("identity %s has been revoked", receiver)
+	}
+	if len(bundle.IdentityKeyPub) != ed25519.PublicKeySize {
+		return fmt.Errorf("identity %s does not have a valid ed25519 identity key registered", receiver)
+	}
+
+	message := receiptSignedBytes(sender, receiver, seq, status, timestampNs)
+	if !ed25519.Verify(ed25519.PublicKey(bundle.IdentityKeyPub), message, signature) {
+		return fmt.Errorf("receipt signature verification failed for %s", receiver)
+	}
+	return nil
+}
+
+// putReceipt做校验并把回执写进rcptCollection，PostReceipt和ReadConfidentialMessagePage的
+// 自动DELIVERED回执都走这个函数
+func putReceipt(ctx contractapi.TransactionContextInterface, sender string, receiver string, seq uint64, status string, timestampNs int64, signature []byte) error {
+	if status != ReceiptStatusDelivered && status != ReceiptStatusRead && status != ReceiptStatusFailed {
+		return fmt.Errorf("status must be one of %s, %s, %s", ReceiptStatusDelivered, ReceiptStatusRead, ReceiptStatusFailed)
+	}
+
+	if err := verifyReceiptSignature(ctx, sender, receiver, seq, status, timestampNs, signature); err != nil {
+		return err
+	}
+
+	receipt := Receipt{
+		Sender:      sender,
+		Receiver:    receiver,
+		Seq:         seq,
+		Status:      status,
+		TimestampNs: timestampNs,
+		Signature:   signature,
+	}
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+
+	key, err := receiptKey(ctx, sender, receiver, seq)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutPrivateData(rcptCollection, key, receiptJSON); err != nil {
+		return fmt.Errorf("failed to put receipt: %s", err.Error())
+	}
+	return nil
+}
+
+// PostReceipt只能由receiver的组织调用（和ReadConfidentialMessage的身份检查方式一致），
+// 并且必须带上receiver对这条回执内容的ed25519签名，这样sender看到的回执是有非否认性的
+func (s *SmartContract) PostReceipt(ctx contractapi.TransactionContextInterface, sender string, receiver string, seq uint64, status string, timestampNs int64, signature []byte) error {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if receiver+"MSP" != clientMSPID {
+		return fmt.Errorf("receiver and client MSPID is not match")
+	}
+
+	if err := putReceipt(ctx, sender, receiver, seq, status, timestampNs, signature); err != nil {
+		return fmt.Errorf("PostReceipt cannot be performed: %v", err)
+	}
+	return nil
+}
+
+// QueryReceipts由sender调用，拉取receiver对某条thread里seq大于sinceSeq的全部回执，
+// 用来维护类似WhatsApp单勾/双勾的送达状态
+func (s *SmartContract) QueryReceipts(ctx contractapi.TransactionContextInterface, sender string, receiver string, sinceSeq uint64) ([]Receipt, error) {
+	clientMSPID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get verified MSPID: %v", err)
+	}
+	if sender+"MSP" != clientMSPID {
+		return nil, fmt.Errorf("sender and client MSPID is not match")
+	}
+
+	iterator, err := ctx.GetStub().GetPrivateDataByPartialCompositeKey(rcptCollection, "rcpt", []string{sender, receiver})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query receipts: %s", err.Error())
+	}
+	defer iterator.Close()
+
+	var receipts []Receipt
+	for iterator.HasNext() {
+		item, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var receipt Receipt
+		if err := json.Unmarshal(item.Value, &receipt); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal receipt: %v", err)
+		}
+		if receipt.Seq <= sinceSeq {
+			continue
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
@@ -9,7 +9,7 @@ import (
 
 func main() {
 
-	chaincode, err := contractapi.NewChaincode(&Communication.SmartContract{})
+	chaincode, err := contractapi.NewChaincode(&Communication.SmartContract{}, &Communication.KeyDirectory{})
 
 	if err != nil {
 		fmt.Printf("Error creating private communication chaincode: %s", err.Error())
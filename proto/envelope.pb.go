@@ -0,0 +1,182 @@
+// Hand-written counterpart of envelope.proto (see that file for the schema).
+// protoc/protoc-gen-go aren't available in this build environment, so this
+// is maintained by hand to match what protoc-gen-go would emit: the same
+// struct tags and method set the reflection-based golang/protobuf marshaler
+// expects. One naming difference: prekey_id is exposed as PreKeyID/GetPreKeyID,
+// where protoc-gen-go would emit PrekeyId/GetPrekeyId.
+// Keep it in sync with envelope.proto when that file changes.
+
+package proto
+
+import (
+	fmt "fmt"
+
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+
+type Envelope struct {
+	Version      uint32   `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Sender       string   `protobuf:"bytes,2,opt,name=sender,proto3" json:"sender,omitempty"`
+	Receivers    []string `protobuf:"bytes,3,rep,name=receivers,proto3" json:"receivers,omitempty"`
+	Ciphertext   []byte   `protobuf:"bytes,4,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	Note         string   `protobuf:"bytes,5,opt,name=note,proto3" json:"note,omitempty"`
+	Nonce        []byte   `protobuf:"bytes,6,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	TimestampNs  int64    `protobuf:"varint,7,opt,name=timestamp_ns,json=timestampNs,proto3" json:"timestamp_ns,omitempty"`
+	ContentType  string   `protobuf:"bytes,8,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	PrevHash     []byte   `protobuf:"bytes,9,opt,name=prev_hash,json=prevHash,proto3" json:"prev_hash,omitempty"`
+	ExpiresAtNs  int64    `protobuf:"varint,10,opt,name=expires_at_ns,json=expiresAtNs,proto3" json:"expires_at_ns,omitempty"`
+	EphemeralPub []byte   `protobuf:"bytes,11,opt,name=ephemeral_pub,json=ephemeralPub,proto3" json:"ephemeral_pub,omitempty"`
+	PreKeyID     string   `protobuf:"bytes,12,opt,name=prekey_id,json=prekeyId,proto3" json:"prekey_id,omitempty"`
+	Pn           uint32   `protobuf:"varint,13,opt,name=pn,proto3" json:"pn,omitempty"`
+	N            uint32   `protobuf:"varint,14,opt,name=n,proto3" json:"n,omitempty"`
+
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Envelope) Reset()         { *m = Envelope{} }
+func (m *Envelope) String() string { return proto.CompactTextString(m) }
+func (*Envelope) ProtoMessage()    {}
+
+func (m *Envelope) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Envelope) GetSender() string {
+	if m != nil {
+		return m.Sender
+	}
+	return ""
+}
+
+func (m *Envelope) GetReceivers() []string {
+	if m != nil {
+		return m.Receivers
+	}
+	return nil
+}
+
+func (m *Envelope) GetCiphertext() []byte {
+	if m != nil {
+		return m.Ciphertext
+	}
+	return nil
+}
+
+func (m *Envelope) GetNote() string {
+	if m != nil {
+		return m.Note
+	}
+	return ""
+}
+
+func (m *Envelope) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *Envelope) GetTimestampNs() int64 {
+	if m != nil {
+		return m.TimestampNs
+	}
+	return 0
+}
+
+func (m *Envelope) GetContentType() string {
+	if m != nil {
+		return m.ContentType
+	}
+	return ""
+}
+
+func (m *Envelope) GetPrevHash() []byte {
+	if m != nil {
+		return m.PrevHash
+	}
+	return nil
+}
+
+func (m *Envelope) GetExpiresAtNs() int64 {
+	if m != nil {
+		return m.ExpiresAtNs
+	}
+	return 0
+}
+
+func (m *Envelope) GetEphemeralPub() []byte {
+	if m != nil {
+		return m.EphemeralPub
+	}
+	return nil
+}
+
+func (m *Envelope) GetPreKeyID() string {
+	if m != nil {
+		return m.PreKeyID
+	}
+	return ""
+}
+
+func (m *Envelope) GetPn() uint32 {
+	if m != nil {
+		return m.Pn
+	}
+	return 0
+}
+
+func (m *Envelope) GetN() uint32 {
+	if m != nil {
+		return m.N
+	}
+	return 0
+}
+
+type ThreadState struct {
+	Sender    string      `protobuf:"bytes,1,opt,name=sender,proto3" json:"sender,omitempty"`
+	Receiver  string      `protobuf:"bytes,2,opt,name=receiver,proto3" json:"receiver,omitempty"`
+	Envelopes []*Envelope `protobuf:"bytes,3,rep,name=envelopes,proto3" json:"envelopes,omitempty"`
+
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ThreadState) Reset()         { *m = ThreadState{} }
+func (m *ThreadState) String() string { return proto.CompactTextString(m) }
+func (*ThreadState) ProtoMessage()    {}
+
+func (m *ThreadState) GetSender() string {
+	if m != nil {
+		return m.Sender
+	}
+	return ""
+}
+
+func (m *ThreadState) GetReceiver() string {
+	if m != nil {
+		return m.Receiver
+	}
+	return ""
+}
+
+func (m *ThreadState) GetEnvelopes() []*Envelope {
+	if m != nil {
+		return m.Envelopes
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Envelope)(nil), "chaincode.Envelope")
+	proto.RegisterType((*ThreadState)(nil), "chaincode.ThreadState")
+}